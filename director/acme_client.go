@@ -0,0 +1,404 @@
+package director
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// defaultACMEPollInterval and maxACMEPollAttempts bound how long
+// pollAuthorization/Finalize wait for the CA to finish validating a
+// challenge or issuing a certificate. A positive Retry-After header from
+// the CA replaces the poll interval (whether shorter or longer); the number
+// of attempts is always capped at maxACMEPollAttempts.
+const (
+	defaultACMEPollInterval = 2 * time.Second
+	maxACMEPollAttempts     = 10
+)
+
+// acmeHTTPClient is the default acmeClient, speaking RFC 8555 (ACME)
+// directly over HTTP to any compliant CA (Let's Encrypt, step-ca, etc).
+type acmeHTTPClient struct {
+	httpClient *http.Client
+
+	directoryURL string
+	directory    acmeDirectory
+
+	accountKey *ecdsa.PrivateKey
+	accountURL string
+
+	nonce string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeAccountResponse struct {
+	Status string `json:"status"`
+}
+
+type acmeOrderResponse struct {
+	Status         string   `json:"status"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Authorizations []string `json:"authorizations"`
+}
+
+type acmeAuthorizationResponse struct {
+	Status     string              `json:"status"`
+	Identifier acmeIdentifier      `json:"identifier"`
+	Challenges []acmeChallengeInfo `json:"challenges"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeChallengeInfo struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+// newACMEHTTPClient fetches the ACME directory at directoryURL and prepares
+// a client ready to register an account and place orders against it.
+func newACMEHTTPClient(directoryURL string) (*acmeHTTPClient, error) {
+	c := &acmeHTTPClient{httpClient: &http.Client{}, directoryURL: directoryURL}
+
+	resp, err := c.httpClient.Get(directoryURL)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Fetching ACME directory")
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	err = json.NewDecoder(resp.Body).Decode(&c.directory)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Unmarshaling ACME directory")
+	}
+
+	return c, nil
+}
+
+// EnsureAccount creates an ACME account key (if one hasn't been created yet
+// on this client) and registers it with the CA.
+func (c *acmeHTTPClient) EnsureAccount() error {
+	if c.accountKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Generating ACME account key")
+		}
+		c.accountKey = key
+	}
+
+	body := map[string]interface{}{"termsOfServiceAgreed": true}
+
+	var accountResp acmeAccountResponse
+	resp, err := c.signedPost(c.directory.NewAccount, body, &accountResp)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Registering ACME account")
+	}
+
+	c.accountURL = resp.Header.Get("Location")
+
+	return nil
+}
+
+// NewOrder submits a new-order request for identifiers and returns the
+// resulting order.
+func (c *acmeHTTPClient) NewOrder(identifiers []string) (acmeOrder, error) {
+	idents := make([]acmeIdentifier, len(identifiers))
+	for i, id := range identifiers {
+		idents[i] = acmeIdentifier{Type: "dns", Value: id}
+	}
+
+	var orderResp acmeOrderResponse
+	resp, err := c.signedPost(c.directory.NewOrder, map[string]interface{}{"identifiers": idents}, &orderResp)
+	if err != nil {
+		return acmeOrder{}, bosherr.WrapErrorf(err, "Creating ACME order")
+	}
+
+	return acmeOrder{
+		URL:               resp.Header.Get("Location"),
+		FinalizeURL:       orderResp.Finalize,
+		CertificateURL:    orderResp.Certificate,
+		AuthorizationURLs: orderResp.Authorizations,
+		Status:            orderResp.Status,
+	}, nil
+}
+
+// Authorize fetches the authorization at authzURL, selects the challenge
+// type solver supports, and responds to it, then waits for the
+// authorization to reach the 'valid' status.
+func (c *acmeHTTPClient) Authorize(authzURL string, solver ChallengeSolver) error {
+	var authz acmeAuthorizationResponse
+	_, err := c.signedPost(authzURL, nil, &authz)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Fetching authorization")
+	}
+
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	challenge, err := c.selectChallenge(authz, solver)
+	if err != nil {
+		return err
+	}
+
+	keyAuth, err := c.keyAuthorization(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	err = solver.Solve(authz.Identifier.Value, challenge.Token, keyAuth)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Solving challenge")
+	}
+	defer solver.CleanUp(authz.Identifier.Value, challenge.Token, keyAuth) //nolint:errcheck
+
+	_, err = c.signedPost(challenge.URL, map[string]interface{}{}, &acmeChallengeInfo{})
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Responding to challenge")
+	}
+
+	return c.pollAuthorization(authzURL)
+}
+
+func (c *acmeHTTPClient) selectChallenge(authz acmeAuthorizationResponse, solver ChallengeSolver) (acmeChallengeInfo, error) {
+	wantType := "http-01"
+	if _, ok := solver.(DNSChallengeSolver); ok {
+		wantType = "dns-01"
+	}
+
+	for _, ch := range authz.Challenges {
+		if ch.Type == wantType {
+			return ch, nil
+		}
+	}
+
+	return acmeChallengeInfo{}, bosherr.Errorf("No '%s' challenge offered for '%s'", wantType, authz.Identifier.Value)
+}
+
+func (c *acmeHTTPClient) pollAuthorization(authzURL string) error {
+	interval := defaultACMEPollInterval
+
+	for i := 0; i < maxACMEPollAttempts; i++ {
+		var authz acmeAuthorizationResponse
+		resp, err := c.signedPost(authzURL, nil, &authz)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Polling authorization")
+		}
+
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid":
+			return bosherr.Errorf("Authorization for '%s' failed", authz.Identifier.Value)
+		}
+
+		if delay := retryAfterDelay(resp); delay > 0 {
+			interval = delay
+		}
+		time.Sleep(interval)
+	}
+
+	return bosherr.Error("Timed out waiting for authorization to become valid")
+}
+
+// Finalize submits the CSR for order and polls until the CA has issued the
+// certificate.
+func (c *acmeHTTPClient) Finalize(order acmeOrder, csrDER []byte) (acmeOrder, error) {
+	body := map[string]interface{}{"csr": base64.RawURLEncoding.EncodeToString(csrDER)}
+
+	var orderResp acmeOrderResponse
+	resp, err := c.signedPost(order.FinalizeURL, body, &orderResp)
+	if err != nil {
+		return order, bosherr.WrapErrorf(err, "Finalizing order")
+	}
+
+	interval := defaultACMEPollInterval
+
+	for i := 0; i < maxACMEPollAttempts && orderResp.Status != "valid"; i++ {
+		if delay := retryAfterDelay(resp); delay > 0 {
+			interval = delay
+		}
+		time.Sleep(interval)
+
+		resp, err = c.signedPost(order.URL, nil, &orderResp)
+		if err != nil {
+			return order, bosherr.WrapErrorf(err, "Polling order")
+		}
+	}
+
+	if orderResp.Status != "valid" {
+		return order, bosherr.Errorf("Order did not become valid, last status '%s'", orderResp.Status)
+	}
+
+	order.Status = orderResp.Status
+	order.CertificateURL = orderResp.Certificate
+
+	return order, nil
+}
+
+// DownloadCertificate fetches the issued certificate chain (PEM-encoded)
+// for order.
+func (c *acmeHTTPClient) DownloadCertificate(order acmeOrder) ([]byte, error) {
+	resp, err := c.signedPostRaw(order.CertificateURL, nil)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Downloading certificate")
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	chain, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Reading certificate chain")
+	}
+
+	return chain, nil
+}
+
+func (c *acmeHTTPClient) keyAuthorization(token string) (string, error) {
+	jwk := jose.JSONWebKey{Key: &c.accountKey.PublicKey}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Computing account key thumbprint")
+	}
+
+	return fmt.Sprintf("%s.%s", token, base64.RawURLEncoding.EncodeToString(thumbprint)), nil
+}
+
+func (c *acmeHTTPClient) signedPost(url string, payload interface{}, out interface{}) (*http.Response, error) {
+	resp, err := c.signedPostRaw(url, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return resp, bosherr.WrapErrorf(err, "Unmarshaling ACME response")
+		}
+	}
+
+	return resp, nil
+}
+
+// signedPostRaw JWS-signs payload with the account key (adding the account
+// URL as the "kid" header once the account has been registered) and POSTs it
+// to url, refreshing the anti-replay nonce the CA requires on every request.
+func (c *acmeHTTPClient) signedPostRaw(url string, payload interface{}) (*http.Response, error) {
+	nonce, err := c.fetchNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	signerOpts := jose.SignerOptions{NonceSource: staticNonceSource(nonce)}
+	signerOpts.WithHeader("url", url)
+	if c.accountURL != "" {
+		signerOpts.WithHeader("kid", c.accountURL)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: c.accountKey}, &signerOpts)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Building JWS signer")
+	}
+
+	var payloadBytes []byte
+	if payload != nil {
+		payloadBytes, err = json.Marshal(payload)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Marshaling ACME request body")
+		}
+	}
+
+	jws, err := signer.Sign(payloadBytes)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Signing ACME request")
+	}
+
+	body := jws.FullSerialize()
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Building ACME request")
+	}
+	req.Header.Add("Content-Type", "application/jose+json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Sending ACME request to '%s'", url)
+	}
+
+	if replay := resp.Header.Get("Replay-Nonce"); replay != "" {
+		c.nonce = replay
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close() //nolint:errcheck
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, bosherr.Errorf("ACME request to '%s' failed with %d: %s", url, resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+func (c *acmeHTTPClient) fetchNonce() (string, error) {
+	if c.nonce != "" {
+		nonce := c.nonce
+		c.nonce = ""
+		return nonce, nil
+	}
+
+	resp, err := c.httpClient.Head(c.directory.NewNonce)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Fetching ACME nonce")
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	return resp.Header.Get("Replay-Nonce"), nil
+}
+
+// retryAfterDelay parses resp's Retry-After header (seconds form, the only
+// form ACME CAs are expected to send) and returns how long to wait before
+// the next poll attempt, or 0 if resp carries no usable Retry-After.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs <= 0 {
+		return 0
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
+type staticNonceSource string
+
+func (s staticNonceSource) Nonce() (string, error) {
+	return string(s), nil
+}
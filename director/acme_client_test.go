@@ -0,0 +1,164 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeChallengeSolver records the challenge it was asked to solve without
+// actually doing anything; the fake CA in this test doesn't check that the
+// challenge was actually satisfied.
+type fakeChallengeSolver struct {
+	solved bool
+}
+
+func (s *fakeChallengeSolver) Solve(identifier string, token string, keyAuthorization string) error {
+	s.solved = true
+	return nil
+}
+
+func (s *fakeChallengeSolver) CleanUp(identifier string, token string, keyAuthorization string) error {
+	return nil
+}
+
+// TestACMEClientOrderAuthorizeFinalizeFlow drives acmeHTTPClient against a
+// fake CA that reports a not-yet-valid status at least once (with a
+// Retry-After header) before becoming "valid", for both the authorization
+// poll ("pending") and the order poll ("processing"), to exercise the backoff added alongside the order/authorize/finalize
+// flow.
+func TestACMEClientOrderAuthorizeFinalizeFlow(t *testing.T) {
+	var server *httptest.Server
+	authzRequests := 0
+
+	mux := http.NewServeMux()
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v) //nolint:errcheck
+	}
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, acmeDirectory{
+			NewNonce:   server.URL + "/new-nonce",
+			NewAccount: server.URL + "/new-account",
+			NewOrder:   server.URL + "/new-order",
+		})
+	})
+
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+	})
+
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", server.URL+"/acct/1")
+		writeJSON(w, acmeAccountResponse{Status: "valid"})
+	})
+
+	mux.HandleFunc("/new-order", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", server.URL+"/order/1")
+		writeJSON(w, acmeOrderResponse{
+			Status:         "pending",
+			Finalize:       server.URL + "/order/1/finalize",
+			Certificate:    server.URL + "/order/1/cert",
+			Authorizations: []string{server.URL + "/authz/1"},
+		})
+	})
+
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		authzRequests++
+
+		authz := acmeAuthorizationResponse{
+			Status:     "pending",
+			Identifier: acmeIdentifier{Type: "dns", Value: "example.com"},
+			Challenges: []acmeChallengeInfo{
+				{Type: "http-01", URL: server.URL + "/chal/1", Token: "tok123"},
+			},
+		}
+
+		switch authzRequests {
+		case 1:
+			// Authorize's initial fetch, before the challenge has been responded to.
+		case 2:
+			// pollAuthorization's first attempt: still pending, tells the client
+			// to wait before asking again.
+			w.Header().Set("Retry-After", "1")
+		default:
+			authz.Status = "valid"
+		}
+
+		writeJSON(w, authz)
+	})
+
+	mux.HandleFunc("/chal/1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, acmeChallengeInfo{})
+	})
+
+	finalizeRequests := 0
+	mux.HandleFunc("/order/1/finalize", func(w http.ResponseWriter, r *http.Request) {
+		finalizeRequests++
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, acmeOrderResponse{Status: "processing"})
+	})
+
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, acmeOrderResponse{Status: "valid", Certificate: server.URL + "/order/1/cert"})
+	})
+
+	mux.HandleFunc("/order/1/cert", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		_, _ = w.Write([]byte("fake-cert-chain-bytes")) //nolint:errcheck
+	})
+
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := newACMEHTTPClient(server.URL + "/directory")
+	if err != nil {
+		t.Fatalf("building ACME client: %s", err)
+	}
+
+	err = client.EnsureAccount()
+	if err != nil {
+		t.Fatalf("ensuring account: %s", err)
+	}
+
+	order, err := client.NewOrder([]string{"example.com"})
+	if err != nil {
+		t.Fatalf("creating order: %s", err)
+	}
+
+	solver := &fakeChallengeSolver{}
+
+	err = client.Authorize(order.AuthorizationURLs[0], solver)
+	if err != nil {
+		t.Fatalf("authorizing: %s", err)
+	}
+	if !solver.solved {
+		t.Error("expected the challenge solver to have been invoked")
+	}
+	if authzRequests < 3 {
+		t.Errorf("expected pollAuthorization to retry until valid, only saw %d authz requests", authzRequests)
+	}
+
+	order, err = client.Finalize(order, []byte("dummy-csr-der"))
+	if err != nil {
+		t.Fatalf("finalizing order: %s", err)
+	}
+	if order.Status != "valid" {
+		t.Errorf("expected finalized order to be valid, got status %q", order.Status)
+	}
+	if finalizeRequests != 1 {
+		t.Errorf("expected exactly one finalize request, got %d", finalizeRequests)
+	}
+
+	chain, err := client.DownloadCertificate(order)
+	if err != nil {
+		t.Fatalf("downloading certificate: %s", err)
+	}
+	if string(chain) != "fake-cert-chain-bytes" {
+		t.Errorf("expected downloaded chain to be 'fake-cert-chain-bytes', got %q", chain)
+	}
+}
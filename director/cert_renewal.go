@@ -0,0 +1,313 @@
+package director
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// RenewOpts configures a DirectorImpl.RenewCertificates run.
+type RenewOpts struct {
+	// ACMEDirectoryURL is the RFC 8555 directory endpoint of the CA to renew
+	// against, e.g. Let's Encrypt or a self-hosted step-ca.
+	ACMEDirectoryURL string
+
+	// Threshold is how far in advance of a certificate's NotAfter renewal is
+	// attempted. Certificates expiring further out than Threshold are left
+	// alone.
+	Threshold time.Duration
+
+	// Solver resolves ACME authorization challenges (http-01 or dns-01).
+	Solver ChallengeSolver
+
+	// DryRun stops after the ACME order has been finalized, without
+	// uploading the new certificate/key back to the director, mirroring the
+	// existing CleanUp dry-run behavior.
+	DryRun bool
+}
+
+// RenewalReport summarizes the outcome of a RenewCertificates call, one
+// entry per certificate within the renewal threshold. Certificates outside
+// the threshold get no entry.
+type RenewalReport struct {
+	Renewals []CertificateRenewal
+}
+
+// CertificateRenewal is the per-certificate outcome within a RenewalReport.
+type CertificateRenewal struct {
+	CertificateID string
+	Renewed       bool
+	Error         string
+}
+
+// ChallengeSolver proves control over an identifier to the ACME CA by
+// satisfying the given challenge, and cleans up afterwards regardless of
+// whether validation succeeded. Implementations exist per ACME challenge
+// type (http-01, dns-01).
+type ChallengeSolver interface {
+	Solve(identifier string, token string, keyAuthorization string) error
+	CleanUp(identifier string, token string, keyAuthorization string) error
+}
+
+// DNSProvider creates and removes the TXT record an dns-01 challenge needs
+// at "_acme-challenge.<domain>", similar to lego's provider interface.
+type DNSProvider interface {
+	Present(domain string, keyAuthorization string) error
+	CleanUp(domain string, keyAuthorization string) error
+}
+
+// DNSChallengeSolver satisfies dns-01 challenges via a pluggable DNSProvider.
+type DNSChallengeSolver struct {
+	Provider DNSProvider
+}
+
+func (s DNSChallengeSolver) Solve(identifier string, token string, keyAuthorization string) error {
+	return s.Provider.Present(identifier, keyAuthorization)
+}
+
+func (s DNSChallengeSolver) CleanUp(identifier string, token string, keyAuthorization string) error {
+	return s.Provider.CleanUp(identifier, keyAuthorization)
+}
+
+// HTTPChallengeSolver satisfies http-01 challenges by serving the
+// key-authorization for the expected token path from a local listener, the
+// same approach lego's built-in HTTP provider takes.
+type HTTPChallengeSolver struct {
+	ListenAddr string
+
+	server *http.Server
+}
+
+func (s *HTTPChallengeSolver) Solve(identifier string, token string, keyAuthorization string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/"+token, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(keyAuthorization)) //nolint:errcheck
+	})
+
+	s.server = &http.Server{Addr: s.ListenAddr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return bosherr.WrapErrorf(err, "Starting http-01 challenge listener")
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func (s *HTTPChallengeSolver) CleanUp(identifier string, token string, keyAuthorization string) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// acmeClient is the minimal subset of the RFC 8555 protocol RenewCertificates
+// drives. It's kept as an interface so tests can substitute a fake CA.
+type acmeClient interface {
+	EnsureAccount() error
+	NewOrder(identifiers []string) (acmeOrder, error)
+	Authorize(authzURL string, solver ChallengeSolver) error
+	Finalize(order acmeOrder, csrDER []byte) (acmeOrder, error)
+	DownloadCertificate(order acmeOrder) ([]byte, error)
+}
+
+type acmeOrder struct {
+	URL               string
+	FinalizeURL       string
+	CertificateURL    string
+	AuthorizationURLs []string
+	Status            string
+}
+
+// RenewCertificates inspects the director's certificate expiry report and,
+// for every certificate whose NotAfter falls within opts.Threshold, drives
+// an ACME order against opts.ACMEDirectoryURL to mint and install a
+// replacement.
+func (d DirectorImpl) RenewCertificates(opts RenewOpts) (RenewalReport, error) {
+	expiring, err := d.CertificateExpiry()
+	if err != nil {
+		return RenewalReport{}, bosherr.WrapErrorf(err, "Fetching certificate expiry report")
+	}
+
+	client, err := newACMEHTTPClient(opts.ACMEDirectoryURL)
+	if err != nil {
+		return RenewalReport{}, bosherr.WrapErrorf(err, "Building ACME client for '%s'", opts.ACMEDirectoryURL)
+	}
+
+	err = client.EnsureAccount()
+	if err != nil {
+		return RenewalReport{}, bosherr.WrapErrorf(err, "Registering ACME account")
+	}
+
+	var report RenewalReport
+
+	for _, cert := range expiring {
+		if !cert.withinThreshold(opts.Threshold) {
+			continue
+		}
+
+		renewal := CertificateRenewal{CertificateID: cert.id()}
+
+		err := d.renewOne(client, cert, opts)
+		if err != nil {
+			renewal.Error = err.Error()
+		} else {
+			renewal.Renewed = true
+		}
+
+		report.Renewals = append(report.Renewals, renewal)
+	}
+
+	return report, nil
+}
+
+func (d DirectorImpl) renewOne(client acmeClient, cert CertificateExpiryInfo, opts RenewOpts) error {
+	order, err := client.NewOrder(cert.identifiers())
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Creating ACME order for '%s'", cert.id())
+	}
+
+	for _, authzURL := range order.AuthorizationURLs {
+		err = client.Authorize(authzURL, opts.Solver)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Authorizing '%s'", authzURL)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Generating renewal key")
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: cert.identifiers(),
+	}, key)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Generating CSR")
+	}
+
+	order, err = client.Finalize(order, csrDER)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Finalizing ACME order")
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+
+	chain, err := client.DownloadCertificate(order)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Downloading renewed certificate chain")
+	}
+
+	keyPEM, err := marshalECKeyPEM(key)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Marshaling renewal key")
+	}
+
+	return d.client.UploadCertificate(cert.id(), chain, keyPEM)
+}
+
+// UploadCertificate installs a freshly renewed certificate/key pair for
+// certID, falling back to writing it to the BOSH config blobstore (for
+// operator-driven rotation) when the director doesn't expose the
+// certificate upload endpoint.
+func (c Client) UploadCertificate(certID string, certChainPEM []byte, keyPEM []byte) error {
+	body, err := json.Marshal(map[string]string{
+		"certificate_pem": string(certChainPEM),
+		"private_key_pem": string(keyPEM),
+	})
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Marshaling request body")
+	}
+
+	setHeaders := func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	path := fmt.Sprintf("/director/certificates/%s", certID)
+
+	_, response, err := c.clientRequest.RawPut(path, body, setHeaders)
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return c.uploadCertificateToConfigBlobstore(certID, certChainPEM, keyPEM)
+		}
+		return bosherr.WrapErrorf(err, "Uploading renewed certificate '%s'", certID)
+	}
+
+	return nil
+}
+
+// uploadCertificateToConfigBlobstore is the fallback path for directors that
+// don't support PUT /director/certificates/{id}: it writes the renewed
+// keypair to the BOSH config blobstore so an operator can pick it up and
+// complete the rotation manually.
+func (c Client) uploadCertificateToConfigBlobstore(certID string, certChainPEM []byte, keyPEM []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"type": fmt.Sprintf("certificate/%s", certID),
+		"content": map[string]string{
+			"certificate_pem": string(certChainPEM),
+			"private_key_pem": string(keyPEM),
+		},
+	})
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Marshaling request body")
+	}
+
+	setHeaders := func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	_, _, err = c.clientRequest.RawPut("/configs", body, setHeaders)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Writing renewed certificate '%s' to config blobstore", certID)
+	}
+
+	return nil
+}
+
+// marshalECKeyPEM PEM-encodes key as an "EC PRIVATE KEY" block. The result
+// is ASCII text, safe to round-trip through a JSON string field (unlike the
+// raw DER bytes x509.MarshalECPrivateKey returns, which aren't valid UTF-8
+// and get silently mangled by json.Marshal).
+func marshalECKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// withinThreshold reports whether cert's expiry falls within threshold of
+// now, i.e. whether it should be renewed.
+func (cert CertificateExpiryInfo) withinThreshold(threshold time.Duration) bool {
+	return time.Until(cert.NotAfter) <= threshold
+}
+
+// id identifies cert for use in RenewalReport and the certificate upload
+// path.
+func (cert CertificateExpiryInfo) id() string {
+	return cert.Name
+}
+
+// identifiers returns the SAN entries to request on the renewal order.
+func (cert CertificateExpiryInfo) identifiers() []string {
+	return cert.SAN
+}
@@ -0,0 +1,56 @@
+package director_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+)
+
+// marshalECKeyPEM isn't exported, so this exercises the same round-trip
+// (generate -> PEM-encode -> JSON string field -> PEM-decode -> parse) that
+// renewOne and UploadCertificate perform together, to guard against the DER-through-JSON-string
+// corruption bug.
+func TestECKeyPEMSurvivesJSONRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %s", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	body, err := json.Marshal(map[string]string{"private_key_pem": string(keyPEM)})
+	if err != nil {
+		t.Fatalf("marshaling JSON body: %s", err)
+	}
+
+	var decodedBody map[string]string
+	err = json.Unmarshal(body, &decodedBody)
+	if err != nil {
+		t.Fatalf("unmarshaling JSON body: %s", err)
+	}
+
+	block, _ := pem.Decode([]byte(decodedBody["private_key_pem"]))
+	if block == nil {
+		t.Fatal("expected a valid PEM block after round-tripping through JSON")
+	}
+	if block.Type != "EC PRIVATE KEY" {
+		t.Errorf("expected 'EC PRIVATE KEY' block, got %q", block.Type)
+	}
+
+	parsedKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parsing round-tripped key: %s", err)
+	}
+	if !parsedKey.Equal(key) {
+		t.Error("expected round-tripped key to equal the original key")
+	}
+}
@@ -0,0 +1,224 @@
+package director
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// DeviceCodeAuth implements the OAuth 2.0 Device Authorization Grant
+// (RFC 8628) against a UAA/OIDC token issuer, so that `bosh log-in` can be
+// completed on machines (jumpboxes, CI runners) where there's no browser to
+// redirect and no terminal to safely type a password into.
+type DeviceCodeAuth struct {
+	httpClient *http.Client
+
+	deviceAuthURL string
+	tokenURL      string
+
+	clientID string
+	scope    string
+	audience string
+}
+
+// DeviceCodeResponse is the response to the initial device authorization
+// request, as defined in RFC 8628 section 3.2.
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceTokenResponse is the successful token response returned once the
+// user has approved the device at VerificationURI.
+type DeviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// TokenStore is implemented by the CLI's config store so that tokens minted
+// by the device flow can be persisted the same way UAA password/client
+// credentials tokens already are.
+type TokenStore interface {
+	SaveTokens(accessToken string, refreshToken string) error
+}
+
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	pollErrAuthorizationPending = "authorization_pending"
+	pollErrSlowDown             = "slow_down"
+	pollErrExpiredToken         = "expired_token"
+	pollErrAccessDenied         = "access_denied"
+
+	defaultPollInterval = 5 * time.Second
+	slowDownIncrement   = 5 * time.Second
+)
+
+type deviceErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// NewDeviceCodeAuth builds a DeviceCodeAuth that talks to the given UAA/OIDC
+// device-authorization and token endpoints on behalf of clientID.
+func NewDeviceCodeAuth(httpClient *http.Client, deviceAuthURL, tokenURL, clientID, scope, audience string) DeviceCodeAuth {
+	return DeviceCodeAuth{
+		httpClient:    httpClient,
+		deviceAuthURL: deviceAuthURL,
+		tokenURL:      tokenURL,
+		clientID:      clientID,
+		scope:         scope,
+		audience:      audience,
+	}
+}
+
+// RequestCode starts the device authorization flow, returning the user code
+// and verification URI the operator must open to approve the login.
+func (a DeviceCodeAuth) RequestCode() (DeviceCodeResponse, error) {
+	var resp DeviceCodeResponse
+
+	form := url.Values{}
+	form.Add("client_id", a.clientID)
+	form.Add("scope", a.scope)
+
+	if a.audience != "" {
+		form.Add("audience", a.audience)
+	}
+
+	httpResp, err := a.post(a.deviceAuthURL, form)
+	if err != nil {
+		return resp, bosherr.WrapErrorf(err, "Requesting device code")
+	}
+	defer httpResp.Body.Close() //nolint:errcheck
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return resp, bosherr.WrapErrorf(err, "Reading device code response")
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return resp, bosherr.Errorf("Requesting device code: director responded with %d: %s", httpResp.StatusCode, body)
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return resp, bosherr.WrapErrorf(err, "Unmarshaling device code response")
+	}
+
+	return resp, nil
+}
+
+// PollForToken polls the token endpoint at the server-dictated interval
+// until the user approves or denies the login, or the device code expires,
+// backing off by 5 seconds (per RFC 8628 section 3.5) every time the server
+// replies with 'slow_down'.
+func (a DeviceCodeAuth) PollForToken(code DeviceCodeResponse) (DeviceTokenResponse, error) {
+	var tokenResp DeviceTokenResponse
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for {
+		if !time.Now().Before(deadline) {
+			return tokenResp, bosherr.Error("Device login was not approved before the device code expired")
+		}
+
+		time.Sleep(interval)
+
+		form := url.Values{}
+		form.Add("grant_type", deviceGrantType)
+		form.Add("device_code", code.DeviceCode)
+		form.Add("client_id", a.clientID)
+
+		httpResp, err := a.post(a.tokenURL, form)
+		if err != nil {
+			return tokenResp, bosherr.WrapErrorf(err, "Polling for device token")
+		}
+
+		body, err := ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close() //nolint:errcheck
+		if err != nil {
+			return tokenResp, bosherr.WrapErrorf(err, "Reading device token response")
+		}
+
+		if httpResp.StatusCode == http.StatusOK {
+			err = json.Unmarshal(body, &tokenResp)
+			if err != nil {
+				return tokenResp, bosherr.WrapErrorf(err, "Unmarshaling device token response")
+			}
+			return tokenResp, nil
+		}
+
+		var errResp deviceErrorResponse
+		err = json.Unmarshal(body, &errResp)
+		if err != nil {
+			return tokenResp, bosherr.Errorf("Polling for device token: director responded with %d: %s", httpResp.StatusCode, body)
+		}
+
+		switch errResp.Error {
+		case pollErrAuthorizationPending:
+			continue
+		case pollErrSlowDown:
+			interval += slowDownIncrement
+			continue
+		case pollErrExpiredToken:
+			return tokenResp, bosherr.Error("Device code expired before login was approved")
+		case pollErrAccessDenied:
+			return tokenResp, bosherr.Error("Device login was denied")
+		default:
+			return tokenResp, bosherr.Errorf("Polling for device token: %s", errResp.Error)
+		}
+	}
+}
+
+// Login runs the full device authorization flow: it requests a device code,
+// prints the user code and verification URI via printCode so the operator
+// can approve the login in a browser elsewhere, polls until a token is
+// issued, and persists the resulting tokens to tokens.
+func (a DeviceCodeAuth) Login(tokens TokenStore, printCode func(DeviceCodeResponse)) (DeviceTokenResponse, error) {
+	code, err := a.RequestCode()
+	if err != nil {
+		return DeviceTokenResponse{}, err
+	}
+
+	printCode(code)
+
+	tokenResp, err := a.PollForToken(code)
+	if err != nil {
+		return DeviceTokenResponse{}, err
+	}
+
+	err = tokens.SaveTokens(tokenResp.AccessToken, tokenResp.RefreshToken)
+	if err != nil {
+		return DeviceTokenResponse{}, bosherr.WrapErrorf(err, "Saving device login tokens")
+	}
+
+	return tokenResp, nil
+}
+
+func (a DeviceCodeAuth) post(rawURL string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Building request to '%s'", rawURL)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+
+	return a.httpClient.Do(req)
+}
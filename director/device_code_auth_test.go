@@ -0,0 +1,83 @@
+package director_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/cloudfoundry/bosh-cli/director"
+)
+
+type fakeTokenStore struct {
+	accessToken  string
+	refreshToken string
+}
+
+func (s *fakeTokenStore) SaveTokens(accessToken string, refreshToken string) error {
+	s.accessToken = accessToken
+	s.refreshToken = refreshToken
+	return nil
+}
+
+func TestDeviceCodeAuthLoginReturnsAndSavesTokens(t *testing.T) {
+	polls := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/device_authorization", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"device_code": "dc123",
+			"user_code": "ABCD-EFGH",
+			"verification_uri": "https://uaa.example.com/activate",
+			"expires_in": 60,
+			"interval": 1
+		}`)
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "authorization_pending"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "at123", "refresh_token": "rt123", "token_type": "bearer", "expires_in": 3600}`)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	auth := NewDeviceCodeAuth(
+		server.Client(),
+		server.URL+"/oauth/device_authorization",
+		server.URL+"/oauth/token",
+		"bosh_cli",
+		"openid",
+		"",
+	)
+
+	var printed DeviceCodeResponse
+	tokens := &fakeTokenStore{}
+
+	tokenResp, err := auth.Login(tokens, func(c DeviceCodeResponse) { printed = c })
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if printed.UserCode != "ABCD-EFGH" {
+		t.Errorf("expected user code to be printed, got %q", printed.UserCode)
+	}
+
+	if tokenResp.AccessToken != "at123" {
+		t.Errorf("expected Login to return the access token, got %q", tokenResp.AccessToken)
+	}
+
+	if tokens.accessToken != "at123" || tokens.refreshToken != "rt123" {
+		t.Errorf("expected tokens to be saved, got access=%q refresh=%q", tokens.accessToken, tokens.refreshToken)
+	}
+
+	if polls < 2 {
+		t.Errorf("expected PollForToken to retry past authorization_pending, only polled %d times", polls)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	gourl "net/url"
 
@@ -14,6 +15,24 @@ import (
 
 type DirectorImpl struct {
 	client Client
+
+	resourceStore ResourceStore
+}
+
+// defaultResourceCacheMaxBytes and defaultResourceCacheMaxAge are the limits
+// the local resource cache is trimmed to by `bosh clean-up`. They are fixed;
+// there is no setting that overrides them.
+const (
+	defaultResourceCacheMaxBytes = 5 * 1024 * 1024 * 1024 // 5 GiB
+	defaultResourceCacheMaxAge   = 30 * 24 * time.Hour
+)
+
+// WithResourceStore returns a copy of the Director that caches resources
+// downloaded via DownloadResourceUnchecked in store, keyed by content digest,
+// instead of always refetching them from the director.
+func (d DirectorImpl) WithResourceStore(store ResourceStore) Director {
+	d.resourceStore = store
+	return d
 }
 
 type OrphanedVMResponse struct {
@@ -63,16 +82,159 @@ func (d DirectorImpl) OrphanedVMs() ([]OrphanedVM, error) {
 	return d.client.OrphanedVMs()
 }
 
+// AdoptTarget identifies where an orphaned VM (and its persistent disks)
+// should be re-attached.
+type AdoptTarget struct {
+	DeploymentName     string
+	InstanceGroup      string
+	InstanceGroupIndex int
+}
+
+// OrphanFilter narrows which orphaned VMs a BulkDeleteOrphanedVMs call
+// applies to, mirroring the CleanUp `remove_all` pattern of acting on many
+// resources in a single task rather than one HTTP call per CID.
+type OrphanFilter struct {
+	AZName         string
+	DeploymentName string
+	OrphanedBefore time.Time
+}
+
+// AdoptOrphanedVM re-attaches the orphaned VM identified by cid to target,
+// recovering it (and its persistent disks) after e.g. a failed deploy
+// orphaned it, instead of requiring it to be recreated from scratch.
+func (d DirectorImpl) AdoptOrphanedVM(cid string, target AdoptTarget) (Task, error) {
+	return d.client.AdoptOrphanedVM(cid, target)
+}
+
+// BulkDeleteOrphanedVMs deletes every orphaned VM matching filter in a
+// single task, instead of deleting them one CID at a time.
+func (d DirectorImpl) BulkDeleteOrphanedVMs(filter OrphanFilter) (Task, error) {
+	return d.client.BulkDeleteOrphanedVMs(filter)
+}
+
+// adoptOrphanedVMBody builds the request body for AdoptOrphanedVM, factored
+// out of the method so the body shape can be asserted on directly without
+// a real Client.
+func adoptOrphanedVMBody(target AdoptTarget) map[string]interface{} {
+	return map[string]interface{}{
+		"deployment_name":      target.DeploymentName,
+		"instance_group":       target.InstanceGroup,
+		"instance_group_index": target.InstanceGroupIndex,
+	}
+}
+
+// bulkDeleteOrphanedVMsBody builds the request body for
+// BulkDeleteOrphanedVMs, omitting each filter field that wasn't set so an
+// unfiltered call doesn't send an empty-string az/deployment_name that the
+// director would interpret as a literal filter value rather than "any".
+// Factored out of the method so the body shape can be asserted on directly
+// without a real Client.
+func bulkDeleteOrphanedVMsBody(filter OrphanFilter) map[string]interface{} {
+	body := map[string]interface{}{}
+
+	if filter.AZName != "" {
+		body["az"] = filter.AZName
+	}
+
+	if filter.DeploymentName != "" {
+		body["deployment_name"] = filter.DeploymentName
+	}
+
+	if !filter.OrphanedBefore.IsZero() {
+		body["orphaned_before"] = filter.OrphanedBefore.Format(time.RFC3339)
+	}
+
+	return body
+}
+
+func (c Client) AdoptOrphanedVM(cid string, target AdoptTarget) (Task, error) {
+	reqBody, err := json.Marshal(adoptOrphanedVMBody(target))
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Marshaling request body")
+	}
+
+	setHeaders := func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	path := fmt.Sprintf("/orphaned_vms/%s/adopt", cid)
+
+	task, err := c.taskClientRequest.PostResult(path, reqBody, setHeaders)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Adopting orphaned VM '%s'", cid)
+	}
+
+	return task, nil
+}
+
+func (c Client) BulkDeleteOrphanedVMs(filter OrphanFilter) (Task, error) {
+	reqBody, err := json.Marshal(bulkDeleteOrphanedVMsBody(filter))
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Marshaling request body")
+	}
+
+	setHeaders := func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	task, err := c.taskClientRequest.PostResult("/orphaned_vms/delete", reqBody, setHeaders)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Bulk deleting orphaned VMs")
+	}
+
+	return task, nil
+}
+
 func (d DirectorImpl) EnableResurrection(enabled bool) error {
 	return d.client.EnableResurrectionAll(enabled)
 }
 
 func (d DirectorImpl) CleanUp(all bool, dryRun bool) (CleanUp, error) {
-	return d.client.CleanUp(all, dryRun)
+	cleanUp, err := d.client.CleanUp(all, dryRun)
+	if err != nil {
+		return cleanUp, err
+	}
+
+	if d.resourceStore != nil && !dryRun {
+		err = d.resourceStore.Prune(defaultResourceCacheMaxBytes, defaultResourceCacheMaxAge)
+		if err != nil {
+			return cleanUp, bosherr.WrapErrorf(err, "Pruning local resource cache")
+		}
+	}
+
+	return cleanUp, nil
 }
 
 func (d DirectorImpl) DownloadResourceUnchecked(blobstoreID string, out io.Writer) error {
-	return d.client.DownloadResourceUnchecked(blobstoreID, out)
+	if d.resourceStore == nil {
+		return d.client.DownloadResourceUnchecked(blobstoreID, out)
+	}
+
+	fetch := func(rangeHeader string, w io.Writer) (string, error) {
+		return d.client.downloadResourceRange(blobstoreID, rangeHeader, w)
+	}
+
+	return d.resourceStore.Get(blobstoreID, "", fetch, out)
+}
+
+// LoginWithDeviceCode runs the OAuth 2.0 Device Authorization Grant against
+// auth, prints the user code via printCode, and persists the resulting
+// tokens via tokens. It's the entry point used when an interactive password
+// prompt isn't available, e.g. logging in from a jumpbox or CI runner.
+//
+// d's own client is unauthenticated by this call: DirectorImpl is an
+// immutable value, so it can't be re-pointed at a new Bearer token in place.
+// The caller is responsible for building an authenticated DirectorImpl from
+// the returned access token, the same way the existing UAA login path
+// builds one from a password/client-credentials token, before issuing
+// further requests.
+func (d DirectorImpl) LoginWithDeviceCode(auth DeviceCodeAuth, tokens TokenStore, printCode func(DeviceCodeResponse)) (DeviceTokenResponse, error) {
+	tokenResp, err := auth.Login(tokens, printCode)
+	if err != nil {
+		return DeviceTokenResponse{}, bosherr.WrapErrorf(err, "Logging in via device code")
+	}
+
+	return tokenResp, nil
 }
 
 func (c Client) EnableResurrectionAll(enabled bool) error {
@@ -0,0 +1,60 @@
+package director
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdoptOrphanedVMBody(t *testing.T) {
+	body := adoptOrphanedVMBody(AdoptTarget{
+		DeploymentName:     "dep1",
+		InstanceGroup:      "ig1",
+		InstanceGroupIndex: 2,
+	})
+
+	expected := map[string]interface{}{
+		"deployment_name":      "dep1",
+		"instance_group":       "ig1",
+		"instance_group_index": 2,
+	}
+
+	for k, v := range expected {
+		if body[k] != v {
+			t.Errorf("expected body[%q] = %v, got %v", k, v, body[k])
+		}
+	}
+}
+
+func TestBulkDeleteOrphanedVMsBodyOmitsUnsetFilters(t *testing.T) {
+	body := bulkDeleteOrphanedVMsBody(OrphanFilter{})
+
+	if _, ok := body["az"]; ok {
+		t.Errorf("expected no 'az' key when AZName is unset, got body %v", body)
+	}
+	if _, ok := body["deployment_name"]; ok {
+		t.Errorf("expected no 'deployment_name' key when DeploymentName is unset, got body %v", body)
+	}
+	if _, ok := body["orphaned_before"]; ok {
+		t.Errorf("expected no 'orphaned_before' key when OrphanedBefore is unset, got body %v", body)
+	}
+}
+
+func TestBulkDeleteOrphanedVMsBodyIncludesSetFilters(t *testing.T) {
+	orphanedBefore := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	body := bulkDeleteOrphanedVMsBody(OrphanFilter{
+		AZName:         "z1",
+		DeploymentName: "dep1",
+		OrphanedBefore: orphanedBefore,
+	})
+
+	if body["az"] != "z1" {
+		t.Errorf("expected body[\"az\"] = \"z1\", got %v", body["az"])
+	}
+	if body["deployment_name"] != "dep1" {
+		t.Errorf("expected body[\"deployment_name\"] = \"dep1\", got %v", body["deployment_name"])
+	}
+	if body["orphaned_before"] != orphanedBefore.Format(time.RFC3339) {
+		t.Errorf("expected body[\"orphaned_before\"] = %q, got %v", orphanedBefore.Format(time.RFC3339), body["orphaned_before"])
+	}
+}
@@ -0,0 +1,372 @@
+package director
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// ResourceStore caches blobs fetched from the director's /resources endpoint
+// on local disk, content-addressed by their SHA256 digest, so that repeated
+// downloads of the same blob (e.g. release/stemcell/compiled-package tarballs
+// pulled by export-release or scp across several `bosh` invocations) are
+// served from disk instead of refetched from the director.
+type ResourceStore interface {
+	// Get fetches blobstoreID into out, consulting the cache first. expectedDigest
+	// may be empty, in which case the digest fetch reports (via its return value,
+	// e.g. from the director's Content-Digest header) is trusted instead, falling
+	// back to a digest computed locally from the downloaded bytes. fetch is only
+	// invoked on a cache miss (or to resume a partial download).
+	Get(blobstoreID string, expectedDigest string, fetch ResourceFetchFunc, out io.Writer) error
+
+	// Prune evicts cache entries until the store is at most maxBytes in size,
+	// removing the oldest entries first, and unconditionally evicts any entry
+	// older than maxAge.
+	Prune(maxBytes int64, maxAge time.Duration) error
+}
+
+// ResourceFetchFunc streams a resource from the director into out, returning
+// the digest the director reported for it (e.g. via a Content-Digest
+// response header), or "" if it didn't report one. When rangeHeader is
+// non-empty, it's the value of an HTTP Range header that the fetcher must
+// forward so a partial local download can be resumed.
+type ResourceFetchFunc func(rangeHeader string, out io.Writer) (digest string, err error)
+
+// FSResourceStore is the on-disk ResourceStore backend. It keys cache
+// entries by "sha256:<digest>", mirroring how OCI registries address blobs
+// in a content-addressable refstore, and coalesces concurrent requests for
+// the same blob so that N parallel `bosh` invocations trigger only one
+// network fetch. Since the blobstore ID a caller asks for doesn't carry its
+// digest, a small index file records the blobstoreID -> digest mapping
+// learned on first download, so later calls for the same blobstoreID (even
+// without a caller-supplied digest) still hit the cache.
+type FSResourceStore struct {
+	dir string
+
+	inFlightMu sync.Mutex
+	inFlight   map[string]*inFlightFetch
+}
+
+type inFlightFetch struct {
+	done   chan struct{}
+	digest string
+	err    error
+}
+
+// NewFSResourceStore returns a ResourceStore backed by dir, creating it if
+// necessary. It's returned as a pointer since FSResourceStore carries a
+// mutex that must not be copied.
+func NewFSResourceStore(dir string) (*FSResourceStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating resource cache directory '%s'", dir)
+	}
+
+	return &FSResourceStore{
+		dir:      dir,
+		inFlight: map[string]*inFlightFetch{},
+	}, nil
+}
+
+func (s *FSResourceStore) Get(blobstoreID string, expectedDigest string, fetch ResourceFetchFunc, out io.Writer) error {
+	digest := expectedDigest
+	if digest == "" {
+		digest = s.lookupIndexedDigest(blobstoreID)
+	}
+
+	if digest != "" && s.copyCached(digest, out) == nil {
+		return nil
+	}
+
+	first, wait := s.claim(blobstoreID)
+	if !first {
+		<-wait.done
+		if wait.err != nil {
+			return wait.err
+		}
+		return s.copyCached(wait.digest, out)
+	}
+
+	digest, err := s.fetchAndCache(blobstoreID, expectedDigest, fetch, out)
+	s.release(blobstoreID, digest, err)
+	return err
+}
+
+// claim registers the calling goroutine as either the one responsible for
+// fetching blobstoreID (first == true), or a follower that should wait on
+// the returned inFlightFetch and then read the now-populated cache entry.
+func (s *FSResourceStore) claim(blobstoreID string) (bool, *inFlightFetch) {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+
+	if existing, ok := s.inFlight[blobstoreID]; ok {
+		return false, existing
+	}
+
+	s.inFlight[blobstoreID] = &inFlightFetch{done: make(chan struct{})}
+	return true, nil
+}
+
+func (s *FSResourceStore) release(blobstoreID string, digest string, err error) {
+	s.inFlightMu.Lock()
+	f := s.inFlight[blobstoreID]
+	delete(s.inFlight, blobstoreID)
+	s.inFlightMu.Unlock()
+
+	if f != nil {
+		f.digest = digest
+		f.err = err
+		close(f.done)
+	}
+}
+
+// fetchAndCache downloads blobstoreID (resuming from any existing .part
+// file), verifies it against expectedDigest (or the digest fetch itself
+// reports) when one is available, caches it under its content digest, and
+// copies it to out. It returns the digest the blob was cached under.
+func (s *FSResourceStore) fetchAndCache(blobstoreID string, expectedDigest string, fetch ResourceFetchFunc, out io.Writer) (string, error) {
+	partPath := filepath.Join(s.dir, sanitizeFilename(blobstoreID)+".part")
+
+	rangeHeader := ""
+	if fi, err := os.Stat(partPath); err == nil && fi.Size() > 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-", fi.Size())
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if rangeHeader != "" {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	partFile, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Opening partial download '%s'", partPath)
+	}
+
+	reportedDigest, err := fetch(rangeHeader, partFile)
+	closeErr := partFile.Close()
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Downloading resource '%s'", blobstoreID)
+	}
+	if closeErr != nil {
+		return "", bosherr.WrapErrorf(closeErr, "Closing partial download '%s'", partPath)
+	}
+
+	digest, err := sha256Digest(partPath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, want := range []string{expectedDigest, reportedDigest} {
+		if want != "" && digest != stripDigestAlgo(want) {
+			_ = os.Remove(partPath) //nolint:errcheck
+			return "", bosherr.Errorf("Downloaded resource '%s' digest '%s' does not match expected digest '%s'", blobstoreID, digest, want)
+		}
+	}
+
+	err = os.Rename(partPath, s.cachePath(digest))
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Caching downloaded resource '%s'", blobstoreID)
+	}
+
+	err = s.storeIndexedDigest(blobstoreID, digest)
+	if err != nil {
+		return "", err
+	}
+
+	return digest, s.copyCached(digest, out)
+}
+
+// copyCached serves out from the cache entry keyed by digest. It returns an
+// error (without touching the cache) if the entry is missing.
+func (s *FSResourceStore) copyCached(digest string, out io.Writer) error {
+	path := s.cachePath(digest)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Opening cached resource '%s'", digest)
+	}
+	defer f.Close() //nolint:errcheck
+
+	_, err = io.Copy(out, f)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Copying cached resource '%s'", digest)
+	}
+
+	return nil
+}
+
+// indexPath maps a blobstoreID to the digest it was last cached under, so a
+// later Get for the same blobstoreID without a caller-supplied digest can
+// still be served from the content-addressed cache.
+func (s *FSResourceStore) indexPath(blobstoreID string) string {
+	return filepath.Join(s.dir, sanitizeFilename(blobstoreID)+".digest")
+}
+
+func (s *FSResourceStore) lookupIndexedDigest(blobstoreID string) string {
+	content, err := ioutil.ReadFile(s.indexPath(blobstoreID))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+func (s *FSResourceStore) storeIndexedDigest(blobstoreID string, digest string) error {
+	err := ioutil.WriteFile(s.indexPath(blobstoreID), []byte(digest), 0600)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Indexing cached resource '%s'", blobstoreID)
+	}
+
+	return nil
+}
+
+// Prune evicts the oldest cache entries (by file modification time, i.e.
+// when they were cached; serving an entry from the cache does not update it)
+// until the store is under maxBytes, and unconditionally evicts entries
+// cached more than maxAge ago. It's invoked from the existing `bosh clean-up`
+// flow.
+func (s *FSResourceStore) Prune(maxBytes int64, maxAge time.Duration) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Listing resource cache directory '%s'", s.dir)
+	}
+
+	var total int64
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var cached []entry
+
+	for _, fi := range entries {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), ".part") || strings.HasSuffix(fi.Name(), ".digest") {
+			continue
+		}
+		total += fi.Size()
+		cached = append(cached, entry{path: filepath.Join(s.dir, fi.Name()), size: fi.Size(), modTime: fi.ModTime()})
+	}
+
+	now := time.Now()
+	for i := len(cached) - 1; i >= 0; i-- {
+		e := cached[i]
+		if maxAge > 0 && now.Sub(e.modTime) > maxAge {
+			if err := os.Remove(e.path); err == nil {
+				total -= e.size
+				cached = append(cached[:i], cached[i+1:]...)
+			}
+		}
+	}
+
+	if maxBytes <= 0 || total <= maxBytes {
+		return nil
+	}
+
+	sort.Slice(cached, func(i, j int) bool { return cached[i].modTime.Before(cached[j].modTime) })
+
+	for i := 0; i < len(cached) && total > maxBytes; i++ {
+		e := cached[i]
+		if err := os.Remove(e.path); err == nil {
+			total -= e.size
+		}
+	}
+
+	return nil
+}
+
+func (s *FSResourceStore) cachePath(digest string) string {
+	return filepath.Join(s.dir, stripDigestAlgo(digest))
+}
+
+func sanitizeFilename(name string) string {
+	return strings.ReplaceAll(name, string(filepath.Separator), "_")
+}
+
+func stripDigestAlgo(digest string) string {
+	for i := 0; i < len(digest); i++ {
+		if digest[i] == ':' {
+			return digest[i+1:]
+		}
+	}
+	return digest
+}
+
+func sha256Digest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Opening '%s' to compute digest", path)
+	}
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Hashing '%s'", path)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadResourceRange streams blobstoreID from the director's /resources
+// endpoint into out, forwarding rangeHeader (when set) as an HTTP Range
+// header so a ResourceStore can resume a partially cached download. It
+// returns the SHA256 digest from the response's Content-Digest header, if
+// the director sent one, so the caller can verify the downloaded bytes.
+func (c Client) downloadResourceRange(blobstoreID string, rangeHeader string, out io.Writer) (string, error) {
+	path := fmt.Sprintf("/resources/%s", blobstoreID)
+
+	setHeaders := func(req *http.Request) {
+		if rangeHeader != "" {
+			req.Header.Add("Range", rangeHeader)
+		}
+	}
+
+	_, resp, err := c.clientRequest.RawGet(path, out, setHeaders)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Downloading resource '%s'", blobstoreID)
+	}
+
+	digest := ""
+	if resp != nil {
+		digest = parseContentDigestSHA256(resp.Header.Get("Content-Digest"))
+	}
+
+	return digest, nil
+}
+
+// parseContentDigestSHA256 extracts a sha256 hex digest out of a
+// Content-Digest header, accepting both the legacy "sha256:<hex>" style BOSH
+// blobstores use and the structured RFC 9530 "sha-256=:<base64>:" style.
+func parseContentDigestSHA256(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+
+		if strings.HasPrefix(part, "sha256:") {
+			return strings.TrimPrefix(part, "sha256:")
+		}
+
+		if strings.HasPrefix(part, "sha-256=:") {
+			encoded := strings.TrimSuffix(strings.TrimPrefix(part, "sha-256=:"), ":")
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err == nil {
+				return hex.EncodeToString(decoded)
+			}
+		}
+	}
+
+	return ""
+}
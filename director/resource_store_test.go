@@ -0,0 +1,147 @@
+package director_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-cli/director"
+)
+
+func TestFSResourceStoreCachesAndServesDownloadedBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resource-store")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	store, err := NewFSResourceStore(dir)
+	if err != nil {
+		t.Fatalf("creating store: %s", err)
+	}
+
+	fetches := 0
+	fetch := func(rangeHeader string, out io.Writer) (string, error) {
+		fetches++
+		_, err := out.Write([]byte("hello world"))
+		return "", err
+	}
+
+	var first bytes.Buffer
+	err = store.Get("blob-1", "", fetch, &first)
+	if err != nil {
+		t.Fatalf("expected no error on first Get, got: %s", err)
+	}
+	if first.String() != "hello world" {
+		t.Errorf("expected first Get to deliver bytes to caller, got %q", first.String())
+	}
+
+	var second bytes.Buffer
+	err = store.Get("blob-1", "", fetch, &second)
+	if err != nil {
+		t.Fatalf("expected no error on cached Get, got: %s", err)
+	}
+	if second.String() != "hello world" {
+		t.Errorf("expected cached Get to deliver bytes to caller, got %q", second.String())
+	}
+	if fetches != 1 {
+		t.Errorf("expected second Get to be served from cache without refetching, fetch was called %d times", fetches)
+	}
+}
+
+func TestFSResourceStoreRejectsDigestMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resource-store")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	store, err := NewFSResourceStore(dir)
+	if err != nil {
+		t.Fatalf("creating store: %s", err)
+	}
+
+	fetch := func(rangeHeader string, out io.Writer) (string, error) {
+		_, err := out.Write([]byte("hello world"))
+		return "", err
+	}
+
+	var out bytes.Buffer
+	err = store.Get("blob-2", "sha256:0000000000000000000000000000000000000000000000000000000000000", fetch, &out)
+	if err == nil {
+		t.Fatal("expected digest mismatch to return an error")
+	}
+}
+
+func TestFSResourceStorePrunesOldestEntriesFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resource-store")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	store, err := NewFSResourceStore(dir)
+	if err != nil {
+		t.Fatalf("creating store: %s", err)
+	}
+
+	put := func(id string, content string, age time.Duration) {
+		var out bytes.Buffer
+		fetch := func(rangeHeader string, w io.Writer) (string, error) {
+			_, err := w.Write([]byte(content))
+			return "", err
+		}
+		err := store.Get(id, "", fetch, &out)
+		if err != nil {
+			t.Fatalf("priming cache entry '%s': %s", id, err)
+		}
+	}
+
+	put("oldest", "aaaaaaaaaa", 0)
+	oldestEntries, _ := ioutil.ReadDir(dir)
+	for _, fi := range oldestEntries {
+		os.Chtimes(dir+"/"+fi.Name(), time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)) //nolint:errcheck
+	}
+
+	put("newest", "bbbbbbbbbb", 0)
+
+	err = store.Prune(15, 0)
+	if err != nil {
+		t.Fatalf("pruning: %s", err)
+	}
+
+	var out bytes.Buffer
+	fetches := 0
+	fetch := func(rangeHeader string, w io.Writer) (string, error) {
+		fetches++
+		_, err := w.Write([]byte("bbbbbbbbbb"))
+		return "", err
+	}
+
+	err = store.Get("newest", "", fetch, &out)
+	if err != nil {
+		t.Fatalf("expected no error reading newest entry after prune: %s", err)
+	}
+	if fetches != 0 {
+		t.Errorf("expected newest entry to survive prune and be served from cache, but it was refetched")
+	}
+
+	var oldestOut bytes.Buffer
+	oldestFetches := 0
+	oldestFetch := func(rangeHeader string, w io.Writer) (string, error) {
+		oldestFetches++
+		_, err := w.Write([]byte("aaaaaaaaaa"))
+		return "", err
+	}
+
+	err = store.Get("oldest", "", oldestFetch, &oldestOut)
+	if err != nil {
+		t.Fatalf("expected no error reading oldest entry after prune: %s", err)
+	}
+	if oldestFetches != 1 {
+		t.Errorf("expected oldest entry to have been pruned and refetched, fetch was called %d times", oldestFetches)
+	}
+}